@@ -0,0 +1,250 @@
+package fastembed
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// untarDedup extracts tarball into modelDir the same way untar does, except
+// each regular file is first written into cacheDir's content-addressed blob
+// store and then linked into place, and a manifest.json recording every
+// file's digest is written alongside the extracted model.
+func untarDedup(tarball io.Reader, cacheDir, modelDir string) error {
+	archive, err := gzip.NewReader(tarball)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	tarReader := tar.NewReader(archive)
+
+	var manifest cacheManifest
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(filepath.Join(cacheDir, header.Name), 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			relPath, err := filepath.Rel(modelDir, filepath.Join(cacheDir, header.Name))
+			if err != nil {
+				return err
+			}
+			entry, err := writeBlob(cacheDir, modelDir, relPath, tarReader)
+			if err != nil {
+				return err
+			}
+			manifest.Entries = append(manifest.Entries, entry)
+		}
+	}
+
+	return saveManifest(modelDir, &manifest)
+}
+
+// manifestFile is the name of the per-model file digest manifest written
+// alongside an extracted model directory.
+const manifestFile = "manifest.json"
+
+// manifestEntry records the digest and size of a single file that was
+// extracted as part of a model's archive.
+type manifestEntry struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+type cacheManifest struct {
+	Entries []manifestEntry `json:"entries"`
+}
+
+// blobDir returns the content-addressed blob store directory for cacheDir,
+// shared across all models cached underneath it.
+func blobDir(cacheDir string) string {
+	return filepath.Join(cacheDir, "blobs", "sha256")
+}
+
+// loadManifest reads the manifest for modelDir, if one exists.
+func loadManifest(modelDir string) (*cacheManifest, error) {
+	data, err := os.ReadFile(filepath.Join(modelDir, manifestFile))
+	if err != nil {
+		return nil, err
+	}
+	var m cacheManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// verifyManifest re-hashes every file listed in m against modelDir, failing
+// on the first mismatch or missing file.
+func verifyManifest(modelDir string, m *cacheManifest) error {
+	for _, entry := range m.Entries {
+		sum, size, err := hashFile(filepath.Join(modelDir, entry.Path))
+		if err != nil {
+			return fmt.Errorf("fastembed: verifying %s: %w", entry.Path, err)
+		}
+		if sum != entry.SHA256 || size != entry.Size {
+			return fmt.Errorf("fastembed: %s failed digest verification", entry.Path)
+		}
+	}
+	return nil
+}
+
+func hashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// writeBlob copies src into cacheDir's content-addressed blob store and
+// links it into modelDir at relPath, returning the manifest entry for the
+// written file. src is always copied into a temporary file in the blob store
+// (to compute the digest); if a blob with the same digest already exists,
+// that temporary copy is discarded and the existing blob is linked instead.
+func writeBlob(cacheDir, modelDir, relPath string, src io.Reader) (manifestEntry, error) {
+	tmp, err := os.CreateTemp(blobDir(cacheDir), "blob-*")
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), src)
+	closeErr := tmp.Close()
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	if closeErr != nil {
+		return manifestEntry{}, closeErr
+	}
+
+	digest := hex.EncodeToString(h.Sum(nil))
+	blobPath := filepath.Join(blobDir(cacheDir), digest)
+
+	if _, err := os.Stat(blobPath); os.IsNotExist(err) {
+		if err := os.Rename(tmpPath, blobPath); err != nil {
+			return manifestEntry{}, err
+		}
+	}
+
+	destPath := filepath.Join(modelDir, relPath)
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return manifestEntry{}, err
+	}
+	os.Remove(destPath)
+	if err := linkBlob(blobPath, destPath); err != nil {
+		return manifestEntry{}, err
+	}
+
+	return manifestEntry{Path: relPath, SHA256: digest, Size: size}, nil
+}
+
+// linkBlob links blobPath into destPath, falling back to a copy on
+// platforms (or filesystems) where hardlinks aren't available.
+func linkBlob(blobPath, destPath string) error {
+	if runtime.GOOS != "windows" {
+		if err := os.Link(blobPath, destPath); err == nil {
+			return nil
+		}
+	}
+	src, err := os.Open(blobPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(destPath)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+func saveManifest(modelDir string, m *cacheManifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(modelDir, manifestFile), data, 0644)
+}
+
+// Verify re-hashes every file in f's model directory against its manifest,
+// returning an error if any file is missing or its content has changed.
+func (f *FlagEmbedding) Verify() error {
+	m, err := loadManifest(f.modelPath)
+	if err != nil {
+		return err
+	}
+	return verifyManifest(f.modelPath, m)
+}
+
+// PurgeCache removes blobs under cacheDir that are no longer referenced by
+// any model manifest, reclaiming disk space after models are deleted or
+// re-downloaded.
+func PurgeCache(cacheDir string) error {
+	referenced := make(map[string]bool)
+
+	modelDirs, err := os.ReadDir(cacheDir)
+	if err != nil {
+		return err
+	}
+	for _, d := range modelDirs {
+		if !d.IsDir() || d.Name() == "blobs" {
+			continue
+		}
+		m, err := loadManifest(filepath.Join(cacheDir, d.Name()))
+		if err != nil {
+			continue
+		}
+		for _, entry := range m.Entries {
+			referenced[entry.SHA256] = true
+		}
+	}
+
+	blobs, err := os.ReadDir(blobDir(cacheDir))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, b := range blobs {
+		if referenced[b.Name()] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(blobDir(cacheDir), b.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -3,6 +3,8 @@ package fastembed
 import (
 	"archive/tar"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -11,6 +13,8 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
 
 	"github.com/schollz/progressbar/v3"
@@ -26,14 +30,19 @@ const (
 	AllMiniLML6V2 EmbeddingModel = "fast-all-MiniLM-L6-v2"
 	BGEBaseEN     EmbeddingModel = "fast-bge-base-en"
 	BGESmallEN    EmbeddingModel = "fast-bge-small-en"
-	// MLE5Large     EmbeddingModel = "intfloat-multilingual-e5-large"
+	MLE5Large     EmbeddingModel = "intfloat-multilingual-e5-large"
 )
 
 type FlagEmbedding struct {
-	tokenizer *tokenizer.Tokenizer
-	model     EmbeddingModel
-	maxLength int
-	modelPath string
+	tokenizer  *tokenizer.Tokenizer
+	model      EmbeddingModel
+	descriptor modelDescriptor
+	maxLength  int
+	modelPath  string
+
+	session   *ort.DynamicAdvancedSession
+	batchSize int
+	slots     chan *sessionSlot
 }
 
 // NOTE:
@@ -49,6 +58,35 @@ type InitOptions struct {
 	CacheDir             string
 	ShowDownloadProgress *bool
 	OnnxPath             string
+
+	// LazyFetch fetches only the files listed in Entries (or, if empty,
+	// "tokenizer.json" and "model_optimized.onnx") from the hosted model
+	// archive via HTTP Range requests against a stargz-style table of
+	// contents, instead of downloading and extracting the whole tar.gz.
+	// If the remote archive has no TOC, NewFlagEmbedding falls back to a
+	// full download automatically.
+	LazyFetch bool
+	Entries   []string
+
+	// VerifyCache re-hashes a cached model's files against its manifest
+	// before reusing it, re-downloading on any mismatch or missing
+	// manifest instead of silently reusing a possibly-corrupt extraction.
+	VerifyCache bool
+
+	// Dedup extracts the model archive into the shared content-addressed
+	// blob store under CacheDir/blobs/sha256 and hardlinks files into the
+	// model directory, so identical files (tokenizer vocabs, configs,
+	// shared weight tensors) aren't stored once per model.
+	Dedup bool
+
+	// Concurrency bounds how many batches Embed runs against the ONNX
+	// session at once. Defaults to runtime.NumCPU().
+	Concurrency int
+
+	// MaxBatchSize sizes the input/output backing buffers pre-allocated for
+	// each slot in the session pool. A call to Embed with a larger batchSize
+	// is split into chunks of at most MaxBatchSize. Defaults to 512.
+	MaxBatchSize int
 }
 
 func NewFlagEmbedding(options *InitOptions) (*FlagEmbedding, error) {
@@ -64,6 +102,19 @@ func NewFlagEmbedding(options *InitOptions) (*FlagEmbedding, error) {
 		options.MaxLength = 512
 	}
 
+	descriptor, ok := modelDescriptors[options.Model]
+	if !ok {
+		return nil, fmt.Errorf("fastembed: unsupported model %q", options.Model)
+	}
+
+	if options.Concurrency <= 0 {
+		options.Concurrency = runtime.NumCPU()
+	}
+
+	if options.MaxBatchSize <= 0 {
+		options.MaxBatchSize = 512
+	}
+
 	if options.ShowDownloadProgress == nil {
 		showDownloadProgress := true
 		options.ShowDownloadProgress = &showDownloadProgress
@@ -80,7 +131,12 @@ func NewFlagEmbedding(options *InitOptions) (*FlagEmbedding, error) {
 		}
 	}
 
-	modelPath, err := retrieveModel(options.Model, options.CacheDir, *options.ShowDownloadProgress)
+	entries := options.Entries
+	if len(entries) == 0 {
+		entries = []string{"tokenizer.json", "model_optimized.onnx"}
+	}
+
+	modelPath, err := retrieveModel(options.Model, options.CacheDir, *options.ShowDownloadProgress, options.LazyFetch, entries, options.VerifyCache, options.Dedup)
 	if err != nil {
 		return nil, err
 	}
@@ -109,22 +165,51 @@ func NewFlagEmbedding(options *InitOptions) (*FlagEmbedding, error) {
 		PadToken:  padToken,
 	}
 	tknzer.WithPadding(&paddingParams)
+
+	sessionOptions, err := buildSessionOptions(options.ExecutionProviders)
+	if err != nil {
+		return nil, err
+	}
+	if sessionOptions != nil {
+		defer sessionOptions.Destroy()
+	}
+
+	onnxPath := filepath.Join(modelPath, "model_optimized.onnx")
+	session, err := newSession(onnxPath, descriptor, sessionOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	slots := make(chan *sessionSlot, options.Concurrency)
+	for i := 0; i < options.Concurrency; i++ {
+		slots <- newSessionSlot(maxLen, options.MaxBatchSize, descriptor.OutputDimension)
+	}
+
 	return &FlagEmbedding{
-		tokenizer: tknzer,
-		model:     options.Model,
-		maxLength: maxLen,
-		modelPath: modelPath,
+		tokenizer:  tknzer,
+		model:      options.Model,
+		descriptor: descriptor,
+		maxLength:  maxLen,
+		modelPath:  modelPath,
+		session:    session,
+		batchSize:  options.MaxBatchSize,
+		slots:      slots,
 	}, nil
 
 }
 
-// Call this function to cleanup the internal onnxruntime environment when it is no longer needed.
+// Call this function to cleanup the session and the internal onnxruntime
+// environment when it is no longer needed.
 func (f *FlagEmbedding) Destroy() {
+	f.session.Destroy()
 	ort.DestroyEnvironment()
 }
 
-func (f *FlagEmbedding) onnxEmbed(input []string) ([]([]float32), error) {
-
+// onnxEmbed runs a single batch through the shared session, reslicing the
+// slot's pre-allocated backing buffers down to len(input) rows instead of
+// always running the slot's full MaxBatchSize, so a lone QueryEmbed call
+// doesn't pay for a full-batch forward pass.
+func (f *FlagEmbedding) onnxEmbed(slot *sessionSlot, input []string) ([]([]float32), error) {
 	inputs := make([]tokenizer.EncodeInput, len(input))
 	for index, v := range input {
 		sequence := tokenizer.NewInputSequence(v)
@@ -136,93 +221,88 @@ func (f *FlagEmbedding) onnxEmbed(input []string) ([]([]float32), error) {
 		return nil, err
 	}
 
-	inputIdsFlat, inputMaskFlat, inputTypeIdsFlat := make([]int64, 0), make([]int64, 0), make([]int64, 0)
-	for _, encoding := range encodings {
+	batch := len(input)
+	idData := slot.idData[:batch*f.maxLength]
+	maskData := slot.maskData[:batch*f.maxLength]
+	typeData := slot.typeData[:batch*f.maxLength]
+	outData := slot.outData[:batch*f.maxLength*f.descriptor.OutputDimension]
+
+	for i, encoding := range encodings {
 		inputIds, inputMask, inputTypeIds := encodingToInt32(encoding.GetIds(), encoding.GetAttentionMask(), encoding.GetTypeIds())
-		inputIdsFlat = append(inputIdsFlat, inputIds...)
-		inputMaskFlat = append(inputMaskFlat, inputMask...)
-		inputTypeIdsFlat = append(inputTypeIdsFlat, inputTypeIds...)
+		copy(idData[i*f.maxLength:], inputIds)
+		copy(maskData[i*f.maxLength:], inputMask)
+		copy(typeData[i*f.maxLength:], inputTypeIds)
 	}
 
-	inputShape := ort.NewShape(int64(len(inputs)), int64(f.maxLength))
-
-	inputTensorID, err := ort.NewTensor(inputShape, inputIdsFlat)
+	shape := ort.NewShape(int64(batch), int64(f.maxLength))
+	inputIDs, err := ort.NewTensor(shape, idData)
 	if err != nil {
 		return nil, err
 	}
-	defer inputTensorID.Destroy()
-
-	inputTensorMask, err := ort.NewTensor(inputShape, inputMaskFlat)
+	defer inputIDs.Destroy()
 
+	inputMask, err := ort.NewTensor(shape, maskData)
 	if err != nil {
 		return nil, err
 	}
-	defer inputTensorMask.Destroy()
-
-	inputTensorType, err := ort.NewTensor(inputShape, inputTypeIdsFlat)
+	defer inputMask.Destroy()
 
+	inputType, err := ort.NewTensor(shape, typeData)
 	if err != nil {
 		return nil, err
 	}
-	defer inputTensorType.Destroy()
+	defer inputType.Destroy()
 
-	outputShape := ort.NewShape(int64(len(inputs)), int64(f.maxLength), 384)
-	outputTensor, err := ort.NewEmptyTensor[float32](outputShape)
+	outputShape := ort.NewShape(int64(batch), int64(f.maxLength), int64(f.descriptor.OutputDimension))
+	output, err := ort.NewTensor(outputShape, outData)
 	if err != nil {
 		return nil, err
 	}
-	defer outputTensor.Destroy()
-
-	session, err := ort.NewAdvancedSession(filepath.Join(f.modelPath, "model_optimized.onnx"), []string{
-		"input_ids", "attention_mask", "token_type_ids",
-	}, []string{
-		"last_hidden_state",
-	}, []ort.ArbitraryTensor{
-		inputTensorID, inputTensorMask, inputTensorType,
-	}, []ort.ArbitraryTensor{outputTensor},
-		nil)
+	defer output.Destroy()
 
-	if err != nil {
+	if err := f.session.Run(
+		[]ort.ArbitraryTensor{inputIDs, inputMask, inputType},
+		[]ort.ArbitraryTensor{output},
+	); err != nil {
 		return nil, err
 	}
 
-	defer session.Destroy()
-
-	err = session.Run()
-	if err != nil {
-		return nil, err
-	}
-
-	return getEmbeddings(outputTensor.GetData(), outputTensor.GetShape()), nil
+	return getEmbeddings(output.GetData(), batch, f.maxLength, f.descriptor.OutputDimension), nil
 }
 
+// Embed runs input through the ONNX session pool in chunks of at most
+// batchSize, bounded by the pool's slot count (InitOptions.Concurrency).
 func (f *FlagEmbedding) Embed(input []string, batchSize int) ([]([]float32), error) {
 	if batchSize <= 0 {
 		batchSize = 512
 	}
+	if batchSize > f.batchSize {
+		batchSize = f.batchSize
+	}
+
 	embeddings := make([]([]float32), len(input))
 	var wg sync.WaitGroup
 	errorCh := make(chan error, len(input))
-	//var resultsMutex sync.Mutex
 
 	for i := 0; i < len(input); i += batchSize {
+		end := i + batchSize
+		if end > len(input) {
+			end = len(input)
+		}
+
+		slot := <-f.slots
 		wg.Add(1)
-		go func(i int) {
+		go func(i, end int, slot *sessionSlot) {
 			defer wg.Done()
-			end := i + batchSize
-			if end > len(input) {
-				end = len(input)
-			}
-			batchOut, err := f.onnxEmbed(input[i:end])
+			defer func() { f.slots <- slot }()
+
+			batchOut, err := f.onnxEmbed(slot, input[i:end])
 			if err != nil {
 				errorCh <- err
+				return
 			}
-			// resultsMutex.Lock()
-			// defer resultsMutex.Unlock()
-			//Removed the mutex as the slice positions being accessed are unique for each goroutine and there is no overlap
 			copy(embeddings[i:end], batchOut)
-
-		}(i)
+		}(i, end, slot)
 	}
 	wg.Wait()
 	close(errorCh)
@@ -236,7 +316,11 @@ func (f *FlagEmbedding) Embed(input []string, batchSize int) ([]([]float32), err
 
 func (f *FlagEmbedding) QueryEmbed(input string) ([]float32, error) {
 	query := "query: " + input
-	data, err := f.onnxEmbed([]string{query})
+
+	slot := <-f.slots
+	defer func() { f.slots <- slot }()
+
+	data, err := f.onnxEmbed(slot, []string{query})
 	if err != nil {
 		return nil, err
 	}
@@ -251,14 +335,46 @@ func (f *FlagEmbedding) PassageEmbed(input []string, batchSize int) ([]([]float3
 	return f.Embed(processedInput, batchSize)
 }
 
-func retrieveModel(model EmbeddingModel, cacheDir string, showDownloadProgress bool) (string, error) {
-	if _, err := os.Stat(filepath.Join(cacheDir, string(model))); !errors.Is(err, fs.ErrNotExist) {
-		return filepath.Join(cacheDir, string(model)), nil
+func retrieveModel(model EmbeddingModel, cacheDir string, showDownloadProgress bool, lazyFetch bool, entries []string, verifyCache bool, dedup bool) (string, error) {
+	modelDir := filepath.Join(cacheDir, string(model))
+	if _, err := os.Stat(modelDir); !errors.Is(err, fs.ErrNotExist) {
+		if !verifyCache {
+			return modelDir, nil
+		}
+		if m, err := loadManifest(modelDir); err == nil && verifyManifest(modelDir, m) == nil {
+			return modelDir, nil
+		}
+		// Manifest missing or a file failed verification; re-fetch below.
+		if err := os.RemoveAll(modelDir); err != nil {
+			return "", err
+		}
 	}
-	return downloadFromGcs(model, cacheDir, showDownloadProgress)
+
+	if lazyFetch {
+		downloadURL := fmt.Sprintf("https://storage.googleapis.com/qdrant-fastembed/%s.tar.gz", model)
+		store := &GcsRangeStore{URL: downloadURL}
+		if err := os.MkdirAll(modelDir, 0755); err != nil {
+			return "", err
+		}
+		switch err := stargzUntar(store, entries, modelDir); {
+		case err == nil:
+			return modelDir, nil
+		case errors.Is(err, errNoTOC):
+			// Remote archive has no TOC; fall through to a full download.
+		default:
+			// modelDir may hold only a subset of entries; don't leave it
+			// behind to be mistaken for a complete cache hit.
+			if rmErr := os.RemoveAll(modelDir); rmErr != nil {
+				return "", rmErr
+			}
+			return "", err
+		}
+	}
+
+	return downloadFromGcs(model, cacheDir, showDownloadProgress, dedup)
 }
 
-func downloadFromGcs(model EmbeddingModel, cacheDir string, showDownloadProgress bool) (string, error) {
+func downloadFromGcs(model EmbeddingModel, cacheDir string, showDownloadProgress bool, dedup bool) (string, error) {
 	downloadURL := fmt.Sprintf("https://storage.googleapis.com/qdrant-fastembed/%s.tar.gz", model)
 
 	response, err := http.Get(downloadURL)
@@ -271,24 +387,38 @@ func downloadFromGcs(model EmbeddingModel, cacheDir string, showDownloadProgress
 		return "", fmt.Errorf("model download failed: %s", response.Status)
 	}
 
+	body := response.Body
+	var reader io.Reader = body
 	if showDownloadProgress {
 		bar := progressbar.DefaultBytes(
 			response.ContentLength,
 			"Downloading "+string(model),
 		)
-		reader := progressbar.NewReader(response.Body, bar)
-		err = untar(&reader, cacheDir)
+		pbReader := progressbar.NewReader(body, bar)
+		reader = &pbReader
+	}
+
+	modelDir := filepath.Join(cacheDir, string(model))
+	if dedup {
+		if err := os.MkdirAll(blobDir(cacheDir), 0755); err != nil {
+			return "", err
+		}
+		err = untarDedup(reader, cacheDir, modelDir)
 	} else {
-		err = untar(response.Body, cacheDir)
+		err = untar(reader, cacheDir, modelDir)
 	}
 
 	if err != nil {
 		return "", err
 	}
-	return filepath.Join(cacheDir, string(model)), nil
+	return modelDir, nil
 }
 
-func untar(tarball io.Reader, target string) error {
+// untar extracts tarball under target, writing a manifest.json into modelDir
+// (a subdirectory of target, per the tarball's own layout) so a later run
+// with InitOptions.VerifyCache can validate this cache entry the same way it
+// would one produced by untarDedup.
+func untar(tarball io.Reader, target, modelDir string) error {
 	archive, err := gzip.NewReader(tarball)
 	if err != nil {
 		return err
@@ -297,6 +427,7 @@ func untar(tarball io.Reader, target string) error {
 
 	tarReader := tar.NewReader(archive)
 
+	var manifest cacheManifest
 	for {
 		header, err := tarReader.Next()
 		if err == io.EOF {
@@ -321,13 +452,31 @@ func untar(tarball io.Reader, target string) error {
 			if err != nil {
 				return err
 			}
-			defer file.Close()
-			if _, err := io.Copy(file, tarReader); err != nil {
+
+			h := sha256.New()
+			_, err = io.Copy(io.MultiWriter(file, h), tarReader)
+			closeErr := file.Close()
+			if err != nil {
 				return err
 			}
+			if closeErr != nil {
+				return closeErr
+			}
+
+			if relPath, err := filepath.Rel(modelDir, path); err == nil && !strings.HasPrefix(relPath, "..") {
+				info, err := os.Stat(path)
+				if err != nil {
+					return err
+				}
+				manifest.Entries = append(manifest.Entries, manifestEntry{
+					Path:   relPath,
+					SHA256: hex.EncodeToString(h.Sum(nil)),
+					Size:   info.Size(),
+				})
+			}
 		}
 	}
-	return nil
+	return saveManifest(modelDir, &manifest)
 }
 
 func normalize(v []float32) []float32 {
@@ -346,14 +495,14 @@ func normalize(v []float32) []float32 {
 	return normalized
 }
 
-// Private function to return the normalized embeddings from a flattened array with the given dimensions
-func getEmbeddings(data []float32, dimensions []int64) []([]float32) {
-	x, y, z := dimensions[0], dimensions[1], dimensions[2]
-	embeddings := make([][]float32, x)
-	var i int64
-	for i = 0; i < x; i++ {
-		startIndex := i * y * z
-		endIndex := startIndex + z
+// Private function to return the normalized embeddings from a flattened array.
+// data is shaped [count, maxLength, dimension]; only the first token's
+// hidden state of each row (the [CLS]-style pooled position) is kept.
+func getEmbeddings(data []float32, count, maxLength, dimension int) []([]float32) {
+	embeddings := make([][]float32, count)
+	for i := 0; i < count; i++ {
+		startIndex := i * maxLength * dimension
+		endIndex := startIndex + dimension
 		embeddings[i] = normalize(data[startIndex:endIndex])
 	}
 	return embeddings
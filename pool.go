@@ -0,0 +1,96 @@
+package fastembed
+
+import (
+	"fmt"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// modelDescriptor captures the ONNX graph details that differ between
+// embedding models, so onnxEmbed doesn't need to hard-code them.
+type modelDescriptor struct {
+	// OutputDimension is the size of the embedding vector this model
+	// produces, i.e. the last dimension of its output tensor.
+	OutputDimension int
+	// OutputNodeName is the name of the graph output holding token-level
+	// hidden states.
+	OutputNodeName string
+}
+
+// modelDescriptors maps each supported EmbeddingModel to its graph details.
+var modelDescriptors = map[EmbeddingModel]modelDescriptor{
+	AllMiniLML6V2: {OutputDimension: 384, OutputNodeName: "last_hidden_state"},
+	BGEBaseEN:     {OutputDimension: 768, OutputNodeName: "last_hidden_state"},
+	BGESmallEN:    {OutputDimension: 384, OutputNodeName: "last_hidden_state"},
+	MLE5Large:     {OutputDimension: 1024, OutputNodeName: "last_hidden_state"},
+}
+
+// newSession builds a dynamic ONNX Runtime session for modelPath. Unlike
+// ort.NewAdvancedSession, a dynamic session isn't bound to fixed input/output
+// tensor shapes at creation time, so the same compiled session can be reused
+// for batches of any row count without padding every call out to a
+// worst-case batch shape.
+func newSession(modelPath string, descriptor modelDescriptor, sessionOptions *ort.SessionOptions) (*ort.DynamicAdvancedSession, error) {
+	return ort.NewDynamicAdvancedSession(modelPath, []string{
+		"input_ids", "attention_mask", "token_type_ids",
+	}, []string{
+		descriptor.OutputNodeName,
+	}, sessionOptions)
+}
+
+// sessionSlot holds the input/output backing buffers reused across calls to
+// onnxEmbed, sized for up to maxBatchSize rows. A call reslices them down to
+// the actual batch length rather than allocating fresh buffers (or padding
+// out to maxBatchSize) on every Embed/QueryEmbed.
+type sessionSlot struct {
+	idData   []int64
+	maskData []int64
+	typeData []int64
+	outData  []float32
+}
+
+func newSessionSlot(maxLength, maxBatchSize, outputDimension int) *sessionSlot {
+	return &sessionSlot{
+		idData:   make([]int64, maxBatchSize*maxLength),
+		maskData: make([]int64, maxBatchSize*maxLength),
+		typeData: make([]int64, maxBatchSize*maxLength),
+		outData:  make([]float32, maxBatchSize*maxLength*outputDimension),
+	}
+}
+
+// buildSessionOptions translates InitOptions.ExecutionProviders into an
+// *ort.SessionOptions, so callers can opt into e.g. CUDA or CoreML instead
+// of always running on the CPU execution provider.
+func buildSessionOptions(providers []string) (*ort.SessionOptions, error) {
+	if len(providers) == 0 {
+		return nil, nil
+	}
+
+	sessionOptions, err := ort.NewSessionOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, provider := range providers {
+		switch provider {
+		case "cuda":
+			err = sessionOptions.AppendExecutionProviderCUDA()
+		case "coreml":
+			err = sessionOptions.AppendExecutionProviderCoreML()
+		case "directml":
+			err = sessionOptions.AppendExecutionProviderDirectML()
+		case "openvino":
+			err = sessionOptions.AppendExecutionProviderOpenVINO()
+		case "cpu":
+			// The CPU provider is always available; nothing to append.
+		default:
+			err = fmt.Errorf("fastembed: unknown execution provider %q", provider)
+		}
+		if err != nil {
+			sessionOptions.Destroy()
+			return nil, err
+		}
+	}
+
+	return sessionOptions, nil
+}
@@ -0,0 +1,295 @@
+package fastembed
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// tocFooterSize is the size in bytes of the fixed-width footer appended to a
+// stargz-style tarball. It holds the byte offset and length of the JSON TOC
+// that precedes it, so the TOC itself can be located with a single small
+// Range request regardless of archive size.
+const tocFooterSize = 16
+
+// tocEntry describes a single file stored inside a stargz-style archive.
+// Offset/CompressedSize locate the entry's independently gzipped chunk
+// within the remote tarball; Digest is the sha256 of the uncompressed
+// content, used to verify what we fetched.
+type tocEntry struct {
+	Name             string `json:"name"`
+	Offset           int64  `json:"offset"`
+	CompressedSize   int64  `json:"compressedSize"`
+	UncompressedSize int64  `json:"uncompressedSize"`
+	Digest           string `json:"digest"`
+}
+
+type tableOfContents struct {
+	Entries []tocEntry `json:"entries"`
+}
+
+// RemoteModelStore fetches individual files out of a hosted model archive
+// without requiring the whole archive to be downloaded first.
+type RemoteModelStore interface {
+	// Fetch streams the named entry's uncompressed content to w, or returns
+	// errNoTOC if the remote archive does not support range-based access.
+	Fetch(name string, w io.Writer) error
+}
+
+// errNoTOC is returned by a RemoteModelStore when the remote archive has no
+// usable table of contents, signalling that callers should fall back to a
+// full download.
+var errNoTOC = errors.New("fastembed: remote archive has no table of contents")
+
+// GcsRangeStore is the default RemoteModelStore, reading a stargz-style TOC
+// and entry chunks from a plain HTTPS URL (as used by the GCS model bucket)
+// via HTTP Range requests.
+type GcsRangeStore struct {
+	URL string
+
+	mu  sync.Mutex
+	toc *tableOfContents
+}
+
+// loadTOC fetches the TOC footer with a single suffix Range request and,
+// if present, the TOC itself. It is idempotent: subsequent calls reuse the
+// cached result.
+func (s *GcsRangeStore) loadTOC() (*tableOfContents, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.toc != nil {
+		return s.toc, nil
+	}
+
+	footer, size, status, err := s.suffixGet(tocFooterSize)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusPartialContent || int64(len(footer)) != tocFooterSize {
+		return nil, errNoTOC
+	}
+
+	tocOffset := int64(binary.LittleEndian.Uint64(footer[0:8]))
+	tocSize := int64(binary.LittleEndian.Uint64(footer[8:16]))
+	if tocOffset <= 0 || tocSize <= 0 || tocOffset+tocSize > size {
+		return nil, errNoTOC
+	}
+
+	raw, status, err := s.rangeGet(tocOffset, tocSize)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusPartialContent {
+		return nil, errNoTOC
+	}
+
+	var toc tableOfContents
+	if err := json.Unmarshal(raw, &toc); err != nil {
+		return nil, errNoTOC
+	}
+
+	s.toc = &toc
+	return s.toc, nil
+}
+
+// suffixGet issues a `Range: bytes=-n` request for the last n bytes of the
+// remote object, returning those bytes along with the object's total size as
+// reported by the response's Content-Range header. This locates the TOC
+// footer with a single small request instead of a HEAD plus a separate
+// absolute-range GET.
+func (s *GcsRangeStore) suffixGet(n int64) ([]byte, int64, int, error) {
+	req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=-%d", n))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, 0, resp.StatusCode, nil
+	}
+
+	size, ok := parseContentRangeSize(resp.Header.Get("Content-Range"))
+	if !ok {
+		return nil, 0, 0, errNoTOC
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, n))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return body, size, resp.StatusCode, nil
+}
+
+// parseContentRangeSize extracts the total resource size from a
+// "bytes <start>-<end>/<size>" Content-Range header value.
+func parseContentRangeSize(contentRange string) (int64, bool) {
+	i := strings.LastIndexByte(contentRange, '/')
+	if i < 0 || i+1 >= len(contentRange) {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(contentRange[i+1:], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return size, true
+}
+
+// rangeGet issues a `Range: bytes=offset-(offset+length-1)` request,
+// returning up to length bytes. The response status is checked before the
+// body is read so a server that ignores Range and returns the full object
+// (200 instead of 206) isn't fully buffered into memory.
+func (s *GcsRangeStore) rangeGet(offset, length int64) ([]byte, int, error) {
+	req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, resp.StatusCode, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, length))
+	if err != nil {
+		return nil, 0, err
+	}
+	return body, resp.StatusCode, nil
+}
+
+// Fetch implements RemoteModelStore.
+func (s *GcsRangeStore) Fetch(name string, w io.Writer) error {
+	toc, err := s.loadTOC()
+	if err != nil {
+		return err
+	}
+
+	var entry *tocEntry
+	for i := range toc.Entries {
+		if toc.Entries[i].Name == name {
+			entry = &toc.Entries[i]
+			break
+		}
+	}
+	if entry == nil {
+		return fmt.Errorf("fastembed: entry %q not found in remote TOC", name)
+	}
+
+	chunk, status, err := s.rangeGet(entry.Offset, entry.CompressedSize)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusPartialContent {
+		return errNoTOC
+	}
+
+	gzr, err := gzip.NewReader(bytes.NewReader(chunk))
+	if err != nil {
+		return err
+	}
+	defer gzr.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, h), gzr); err != nil {
+		return err
+	}
+
+	if digest := "sha256:" + hex.EncodeToString(h.Sum(nil)); entry.Digest != "" && digest != entry.Digest {
+		return fmt.Errorf("fastembed: digest mismatch for %q: got %s, want %s", name, digest, entry.Digest)
+	}
+	return nil
+}
+
+// stargzUntar fetches only the requested entries from store in parallel and
+// writes them under target, using the remote TOC instead of extracting a
+// full tarball. Callers should fall back to untar when it returns errNoTOC.
+// On success it writes a manifest.json alongside the fetched entries so a
+// later run can VerifyCache this (necessarily partial) model directory; on
+// any other error the caller is responsible for discarding target, since it
+// may hold only a subset of entries.
+func stargzUntar(store RemoteModelStore, entries []string, target string) error {
+	var (
+		mu       sync.Mutex
+		manifest cacheManifest
+		wg       sync.WaitGroup
+	)
+	errCh := make(chan error, len(entries))
+
+	for _, name := range entries {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			entry, err := fetchEntry(store, name, target)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			mu.Lock()
+			manifest.Entries = append(manifest.Entries, entry)
+			mu.Unlock()
+		}(name)
+	}
+	wg.Wait()
+	close(errCh)
+
+	if len(errCh) > 0 {
+		return <-errCh
+	}
+	return saveManifest(target, &manifest)
+}
+
+// fetchEntry fetches a single TOC entry into target/name, returning the
+// manifest entry describing what was written.
+func fetchEntry(store RemoteModelStore, name, target string) (manifestEntry, error) {
+	path := filepath.Join(target, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return manifestEntry{}, err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+
+	h := sha256.New()
+	err = store.Fetch(name, io.MultiWriter(file, h))
+	closeErr := file.Close()
+	if err != nil {
+		os.Remove(path)
+		return manifestEntry{}, err
+	}
+	if closeErr != nil {
+		return manifestEntry{}, closeErr
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+
+	return manifestEntry{Path: name, SHA256: hex.EncodeToString(h.Sum(nil)), Size: info.Size()}, nil
+}